@@ -0,0 +1,402 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	// newFileSuffix is appended to a file's real path while its new
+	// contents are being staged, prior to the atomic rename that
+	// promotes it into place.
+	newFileSuffix = ".new"
+
+	// pathWriteManifestJSON records every staged write attempted for the
+	// in-flight config application, so a crash mid-apply can be resumed
+	// or cleanly unwound on the next boot.
+	pathWriteManifestJSON = "/etc/machine-config-daemon/write-manifest.json"
+
+	// pathBackupDir holds a copy of each file's previous contents and
+	// mode, taken right before it's overwritten, so validateOnDiskState
+	// failures can be rolled back to the last known-good state.
+	pathBackupDir = "/etc/machine-config-daemon/backups"
+)
+
+// writeManifestEntry records one staged file: where its new contents were
+// written, what its final destination is, and where (if anywhere) its
+// previous contents were backed up.
+type writeManifestEntry struct {
+	Target string `json:"target"`
+	Staged string `json:"staged"`
+	Backup string `json:"backup,omitempty"`
+}
+
+// writeManifest is persisted to pathWriteManifestJSON for the duration of a
+// config application. BootID lets us tell, on the next boot, whether we
+// crashed before attempting the reboot (BootID == current bootID) or
+// whether we rebooted but didn't get to clean up (BootID != current).
+type writeManifest struct {
+	BootID  string               `json:"bootID"`
+	Entries []writeManifestEntry `json:"entries"`
+}
+
+// stagedWriter accumulates a batch of file writes so they can be promoted
+// into place atomically: every file is written to "path.new" and fsynced,
+// and only renamed onto its real path once every file in the batch has
+// landed successfully. This turns MCD's on-disk writes into a crash-safe
+// transaction, borrowing the "write .new, promote atomically" pattern used
+// for kubelet/kubeadm asset transfer.
+type stagedWriter struct {
+	bootID  string
+	entries []writeManifestEntry
+}
+
+func newStagedWriter(bootID string) *stagedWriter {
+	return &stagedWriter{bootID: bootID}
+}
+
+// StageFile backs up path's current contents (if it exists), then writes
+// contents to path+".new" with the given mode and fsyncs it. The write is
+// not visible at path until Commit renames it into place.
+func (w *stagedWriter) StageFile(path string, contents []byte, mode os.FileMode) error {
+	backupPath, err := backupExisting(path)
+	if err != nil {
+		return errors.Wrapf(err, "backing up %q before staged write", path)
+	}
+
+	stagedPath := path + newFileSuffix
+	if err := os.MkdirAll(filepath.Dir(stagedPath), 0755); err != nil {
+		return errors.Wrapf(err, "creating parent directory for %q", stagedPath)
+	}
+	if err := writeFileSync(stagedPath, contents, mode); err != nil {
+		return errors.Wrapf(err, "staging %q", stagedPath)
+	}
+
+	w.entries = append(w.entries, writeManifestEntry{
+		Target: path,
+		Staged: stagedPath,
+		Backup: backupPath,
+	})
+	return nil
+}
+
+// Persist writes the manifest of staged files to disk so a crash between
+// now and Commit can be recovered from on the next boot.
+func (w *stagedWriter) Persist() error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	m := writeManifest{BootID: w.bootID, Entries: w.entries}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pathWriteManifestJSON), 0755); err != nil {
+		return err
+	}
+	return writeFileSync(pathWriteManifestJSON, buf, 0644)
+}
+
+// Commit renames every staged file onto its real target. It should only be
+// called once every file in the batch has been staged successfully; a
+// partial Commit is recoverable via reconcileStagedWrites on the next boot.
+//
+// Commit deliberately leaves pathWriteManifestJSON in place rather than
+// removing it: the caller typically reboots immediately after a successful
+// Commit (see update()), and CheckStateOnBoot needs the manifest to still be
+// there on the other side of that reboot so restoreFromBackups has
+// something to roll back from if validateOnDiskState rejects the result.
+// The manifest is only ever removed once that post-reboot validation has
+// run, by CheckStateOnBoot (on success) or restoreFromBackups (after a
+// rollback).
+func (w *stagedWriter) Commit() error {
+	if len(w.entries) == 0 {
+		// Persist never wrote a manifest for an empty batch, so there's
+		// nothing to promote or clean up.
+		return nil
+	}
+	for _, e := range w.entries {
+		if err := os.Rename(e.Staged, e.Target); err != nil {
+			return errors.Wrapf(err, "promoting %q to %q", e.Staged, e.Target)
+		}
+	}
+	return nil
+}
+
+// Abort removes every staged ".new" file without touching the real
+// targets, used when a batch fails before Commit.
+func (w *stagedWriter) Abort() {
+	for _, e := range w.entries {
+		if err := os.Remove(e.Staged); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to remove staged file %q during abort: %v", e.Staged, err)
+		}
+	}
+	if err := os.Remove(pathWriteManifestJSON); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove write manifest during abort: %v", err)
+	}
+}
+
+// backupExisting copies path's current contents and mode into pathBackupDir
+// under a name derived from its digest, and returns that backup's path. If
+// path doesn't exist yet, it returns ("", nil): there's nothing to restore.
+func backupExisting(path string) (string, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(pathBackupDir, 0700); err != nil {
+		return "", err
+	}
+	backupPath := backupPathFor(path)
+	if err := writeFileSync(backupPath, contents, fi.Mode()); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
+
+// backupPathFor deterministically maps a target path to its location under
+// pathBackupDir, so repeated backups of the same file overwrite each other
+// rather than accumulating.
+func backupPathFor(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(pathBackupDir, hex.EncodeToString(sum[:])+filepath.Ext(path))
+}
+
+// writeFileSync writes contents to path and fsyncs the file before
+// returning, so the write survives a crash immediately after.
+func writeFileSync(path string, contents []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(contents); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// loadWriteManifest reads the persisted manifest, if any. It returns (nil,
+// nil) if no config application is currently in flight.
+func loadWriteManifest() (*writeManifest, error) {
+	buf, err := ioutil.ReadFile(pathWriteManifestJSON)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m writeManifest
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, errors.Wrapf(err, "parsing write manifest")
+	}
+	return &m, nil
+}
+
+// reconcileStagedWrites resolves any write manifest left over from a
+// previous run of the daemon, before we trust the on-disk state enough to
+// validate it.
+//
+// If the manifest's bootID matches ours, we crashed before ever attempting
+// the reboot that would apply it: the staged files never became truth, so
+// we simply discard them and the manifest along with them.
+//
+// If the bootID differs, we rebooted with the manifest still present,
+// meaning we don't know whether the promote-rename step fully completed.
+// We finish promoting whichever staged files remain, and for any staged
+// file that's gone missing (already promoted or never written) we leave
+// the target alone. The manifest itself is deliberately left on disk here:
+// CheckStateOnBoot still needs it after we return, to roll back via
+// restoreFromBackups if validateOnDiskState rejects what we just promoted,
+// or to remove once validation succeeds.
+func (dn *Daemon) reconcileStagedWrites() error {
+	m, err := loadWriteManifest()
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+
+	if m.BootID == dn.bootID {
+		glog.Info("Found a write manifest from this boot; discarding incomplete staged writes")
+		for _, e := range m.Entries {
+			if err := os.Remove(e.Staged); err != nil && !os.IsNotExist(err) {
+				glog.Warningf("failed to remove stale staged file %q: %v", e.Staged, err)
+			}
+		}
+		return os.Remove(pathWriteManifestJSON)
+	}
+
+	glog.Info("Found a write manifest from a previous boot; completing staged writes")
+	for _, e := range m.Entries {
+		if _, err := os.Lstat(e.Staged); err == nil {
+			if err := os.Rename(e.Staged, e.Target); err != nil {
+				return errors.Wrapf(err, "completing promotion of %q", e.Target)
+			}
+			continue
+		}
+		// The staged file is gone: either it was already promoted (the
+		// common case) or it never landed. Either way the target is the
+		// best truth we have; nothing further to do here.
+	}
+	return nil
+}
+
+// restoreFromBackups rolls every file recorded in the write manifest back
+// to its backup, removing targets that had no backup. It's used when validateOnDiskState rejects the freshly
+// applied config: rather than immediately going Degraded, we recover the
+// previous MachineConfig's on-disk state so the node stays in a consistent,
+// schedulable condition while the update is retried.
+func (dn *Daemon) restoreFromBackups() error {
+	m, err := loadWriteManifest()
+	if err != nil || m == nil {
+		// No manifest means no record of what changed in the failed
+		// attempt; there's nothing we can safely roll back.
+		return fmt.Errorf("no write manifest available to roll back from")
+	}
+	for _, e := range m.Entries {
+		if e.Backup == "" {
+			// The file didn't exist before this attempt; remove it.
+			if err := os.Remove(e.Target); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "removing %q while rolling back", e.Target)
+			}
+			continue
+		}
+		contents, err := ioutil.ReadFile(e.Backup)
+		if err != nil {
+			return errors.Wrapf(err, "reading backup for %q", e.Target)
+		}
+		fi, err := os.Lstat(e.Backup)
+		if err != nil {
+			return err
+		}
+		if err := writeFileSync(e.Target, contents, fi.Mode()); err != nil {
+			return errors.Wrapf(err, "restoring %q from backup", e.Target)
+		}
+	}
+	glog.Infof("Restored %d file(s) from backup after on-disk validation failure", len(m.Entries))
+	return os.Remove(pathWriteManifestJSON)
+}
+
+// writeFiles decodes and stages every file in files through a stagedWriter,
+// persists the manifest, and only then commits: a failure while staging
+// leaves every target untouched, while a failure part-way through Commit
+// is left for reconcileStagedWrites. checkedFiles mirrors checkFiles' last-write-wins handling of
+// duplicate paths. Once committed, any path with an entry in
+// securityContexts has its SELinux label and allow-listed xattrs restored,
+// so label/xattr drift gets corrected the same way content drift does
+// rather than only ever being flagged by checkFiles. Pass nil when the
+// caller has no fileSecurityContextAnnotationKey to draw from, e.g. a bare
+// Ignition config outside a MachineConfig.
+func (dn *Daemon) writeFiles(files []ignv2_2types.File, securityContexts map[string]fileSecurityContext) error {
+	w := newStagedWriter(dn.bootID)
+	checkedFiles := make(map[string]bool)
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if checkedFiles[f.Path] {
+			continue
+		}
+		mode := defaultFilePermissions
+		if f.Mode != nil {
+			mode = os.FileMode(*f.Mode)
+		}
+		contents, err := dataurl.DecodeString(f.Contents.Source)
+		if err != nil {
+			w.Abort()
+			return errors.Wrapf(err, "decoding contents for %q", f.Path)
+		}
+		if err := w.StageFile(f.Path, contents.Data, mode); err != nil {
+			w.Abort()
+			return err
+		}
+		checkedFiles[f.Path] = true
+	}
+
+	if err := w.Persist(); err != nil {
+		w.Abort()
+		return errors.Wrap(err, "persisting write manifest")
+	}
+	if err := w.Commit(); err != nil {
+		return errors.Wrap(err, "committing staged files")
+	}
+
+	for path, ctx := range securityContexts {
+		if !checkedFiles[path] {
+			continue
+		}
+		if err := restoreFileSecurityContext(path, ctx); err != nil {
+			return errors.Wrapf(err, "restoring security context for %q", path)
+		}
+	}
+	return nil
+}
+
+// writeUnits stages every systemd unit and dropin in units through the same
+// stagedWriter transaction writeFiles uses, so a unit write survives a
+// mid-apply crash the same way file writes do. Masked units are symlinked
+// to pathDevNull directly, since a mask isn't file content stagedWriter can
+// promote via rename.
+func (dn *Daemon) writeUnits(units []ignv2_2types.Unit) error {
+	w := newStagedWriter(dn.bootID)
+	for _, u := range units {
+		for j := range u.Dropins {
+			if u.Dropins[j].Contents == "" {
+				continue
+			}
+			path := filepath.Join(pathSystemd, u.Name+".d", u.Dropins[j].Name)
+			if err := w.StageFile(path, []byte(u.Dropins[j].Contents), defaultFilePermissions); err != nil {
+				w.Abort()
+				return err
+			}
+		}
+
+		if u.Contents != "" {
+			path := filepath.Join(pathSystemd, u.Name)
+			if err := w.StageFile(path, []byte(u.Contents), defaultFilePermissions); err != nil {
+				w.Abort()
+				return err
+			}
+		}
+	}
+
+	if err := w.Persist(); err != nil {
+		w.Abort()
+		return errors.Wrap(err, "persisting write manifest")
+	}
+	if err := w.Commit(); err != nil {
+		return errors.Wrap(err, "committing staged units")
+	}
+
+	for _, u := range units {
+		if !u.Mask {
+			continue
+		}
+		path := filepath.Join(pathSystemd, u.Name)
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "removing %q before masking", path)
+		}
+		if err := os.Symlink(pathDevNull, path); err != nil {
+			return errors.Wrapf(err, "masking %q", path)
+		}
+	}
+	return nil
+}
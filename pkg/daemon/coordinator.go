@@ -0,0 +1,294 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+)
+
+const (
+	// coordinatorSocketPath is where third-party node-level operators
+	// (SR-IOV, PTP, NTO, ...) dial in to coordinate with MCD instead of
+	// shipping their own daemonset that fights MCD for drain/reboot.
+	coordinatorSocketPath = "/run/machine-config-daemon/coordinator.sock"
+)
+
+// LifecycleEvent identifies a point in MCD's update state machine that
+// external coordinators can subscribe to.
+type LifecycleEvent string
+
+const (
+	// LifecyclePreDrain fires right before MCD starts disrupting the node:
+	// before its own update path runs, and before RequestDrainReboot
+	// writes its fragment (which is not followed by a cordon or drain).
+	LifecyclePreDrain LifecycleEvent = "pre-drain"
+	// LifecyclePostReboot fires once MCD has confirmed its post-reboot state.
+	LifecyclePostReboot LifecycleEvent = "post-reboot"
+	// LifecycleDegraded fires when the node goes Degraded.
+	LifecycleDegraded LifecycleEvent = "degraded"
+)
+
+// Coordinator is the external-facing API third-party node-level operators
+// use to coordinate node disruption with MCD, rather than each shipping its
+// own ad-hoc MCP-pause lock (as sriov-network-operator does today).
+type Coordinator interface {
+	// Hold prevents MCD from starting a new update until the returned
+	// release func is called. holder should be a stable, unique name for
+	// the caller (e.g. "sriov-network-operator").
+	Hold(holder, reason string) (release func(), err error)
+
+	// RequestDrainReboot asks MCD to apply fragment's file/unit deltas
+	// and then reboot the node on the caller's behalf. It takes the
+	// node's slot in the pool's drain lock and pauses the pool first, but
+	// does not cordon or drain the node before rebooting.
+	RequestDrainReboot(holder string, fragment ignv2_2types.Config) error
+
+	// Subscribe returns a channel of lifecycle events. The channel is
+	// closed when the daemon shuts down.
+	Subscribe() <-chan LifecycleEvent
+}
+
+// daemonCoordinator implements Coordinator on top of the same state machine
+// Daemon itself uses: holds gate triggerUpdateWithMachineConfig, and
+// RequestDrainReboot goes through the same coordinateDrain/dn.updateMu
+// coordination triggerUpdateWithMachineConfig does, so the two can never run
+// concurrently against the same on-disk state or the same pool's drain
+// concurrency limit.
+type daemonCoordinator struct {
+	dn *Daemon
+
+	mu    sync.Mutex
+	holds map[string]string
+
+	subMu       sync.Mutex
+	subscribers []chan LifecycleEvent
+
+	listener net.Listener
+}
+
+// newCoordinator constructs a Coordinator for dn but does not yet start
+// serving requests; call Serve to open the Unix socket.
+func newCoordinator(dn *Daemon) *daemonCoordinator {
+	return &daemonCoordinator{
+		dn:    dn,
+		holds: make(map[string]string),
+	}
+}
+
+// Serve opens the coordination Unix socket and accepts connections until
+// stopCh is closed.
+func (c *daemonCoordinator) Serve(stopCh <-chan struct{}) error {
+	if err := os.MkdirAll(filepath.Dir(coordinatorSocketPath), 0755); err != nil {
+		return err
+	}
+	// A stale socket from a previous run would otherwise make Listen fail.
+	_ = os.Remove(coordinatorSocketPath)
+
+	l, err := net.Listen("unix", coordinatorSocketPath)
+	if err != nil {
+		return fmt.Errorf("listening on coordinator socket %s: %v", coordinatorSocketPath, err)
+	}
+	c.listener = l
+
+	go func() {
+		<-stopCh
+		c.listener.Close()
+		c.closeSubscribers()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				glog.V(2).Infof("coordinator: listener closed: %v", err)
+				return
+			}
+			go c.handleConn(conn)
+		}
+	}()
+
+	glog.Infof("Coordinator API listening on %s", coordinatorSocketPath)
+	return nil
+}
+
+// coordinatorRequest is the wire format read from each connection, one JSON
+// object per line.
+type coordinatorRequest struct {
+	Cmd      string               `json:"cmd"`
+	Holder   string               `json:"holder"`
+	Reason   string               `json:"reason,omitempty"`
+	Ignition *ignv2_2types.Config `json:"ignition,omitempty"`
+}
+
+type coordinatorResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (c *daemonCoordinator) handleConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req coordinatorRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			enc.Encode(coordinatorResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+			continue
+		}
+
+		switch req.Cmd {
+		case "hold":
+			release, err := c.Hold(req.Holder, req.Reason)
+			if err != nil {
+				enc.Encode(coordinatorResponse{Error: err.Error()})
+				continue
+			}
+			// The hold lasts as long as the connection does; closing or
+			// dropping the connection releases it automatically.
+			defer release()
+			enc.Encode(coordinatorResponse{OK: true})
+		case "release":
+			c.release(req.Holder)
+			enc.Encode(coordinatorResponse{OK: true})
+		case "drain_reboot":
+			if req.Ignition == nil {
+				enc.Encode(coordinatorResponse{Error: "drain_reboot requires an ignition fragment"})
+				continue
+			}
+			if err := c.RequestDrainReboot(req.Holder, *req.Ignition); err != nil {
+				enc.Encode(coordinatorResponse{Error: err.Error()})
+				continue
+			}
+			enc.Encode(coordinatorResponse{OK: true})
+		case "subscribe":
+			c.streamEvents(conn, enc)
+			return
+		default:
+			enc.Encode(coordinatorResponse{Error: fmt.Sprintf("unknown cmd %q", req.Cmd)})
+		}
+	}
+}
+
+func (c *daemonCoordinator) streamEvents(conn net.Conn, enc *json.Encoder) {
+	ch := c.Subscribe()
+	for ev := range ch {
+		if err := enc.Encode(struct {
+			Event LifecycleEvent `json:"event"`
+		}{ev}); err != nil {
+			return
+		}
+	}
+}
+
+// Hold implements Coordinator.
+func (c *daemonCoordinator) Hold(holder, reason string) (func(), error) {
+	if holder == "" {
+		return nil, fmt.Errorf("holder must be non-empty")
+	}
+	c.mu.Lock()
+	c.holds[holder] = reason
+	c.mu.Unlock()
+	glog.Infof("coordinator: %q is holding updates: %s", holder, reason)
+	return func() { c.release(holder) }, nil
+}
+
+func (c *daemonCoordinator) release(holder string) {
+	c.mu.Lock()
+	delete(c.holds, holder)
+	c.mu.Unlock()
+	glog.Infof("coordinator: %q released its hold", holder)
+}
+
+// isHeld reports whether any external caller currently holds updates, so
+// triggerUpdateWithMachineConfig can defer.
+func (c *daemonCoordinator) isHeld() (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for holder, reason := range c.holds {
+		return true, fmt.Sprintf("%s: %s", holder, reason)
+	}
+	return false, ""
+}
+
+// RequestDrainReboot implements Coordinator. handleConn runs this on its own
+// goroutine per accepted connection, so it goes through the same
+// coordinateDrain/releaseDrainCoordination state machine
+// triggerUpdateWithMachineConfig uses: that acquires this node's slot in the
+// pool's drain lock (respecting maxUnavailable) and pauses the pool for the
+// duration, so a coordinator-requested reboot can't run past the pool's
+// concurrency limit or alongside an MCD-driven update for the same pool. It
+// additionally takes dn.updateMu, the same lock triggerUpdateWithMachineConfig
+// holds across its own write+reboot critical section, so the two can never
+// race over the same on-disk files or reboot call. It does not cordon or
+// drain the node: it writes the fragment and reboots.
+func (c *daemonCoordinator) RequestDrainReboot(holder string, fragment ignv2_2types.Config) error {
+	glog.Infof("coordinator: %q requested a drain+reboot with a %d-file, %d-unit fragment", holder, len(fragment.Storage.Files), len(fragment.Systemd.Units))
+
+	pool, err := c.dn.coordinateDrain()
+	if err != nil {
+		return fmt.Errorf("coordinating drain/reboot with pool: %v", err)
+	}
+
+	c.dn.updateMu.Lock()
+	defer c.dn.updateMu.Unlock()
+
+	c.publish(LifecyclePreDrain)
+
+	if err := c.dn.writeFiles(fragment.Storage.Files, nil); err != nil {
+		c.dn.releaseDrainCoordination(pool)
+		return fmt.Errorf("applying coordinator fragment files: %v", err)
+	}
+	if err := c.dn.writeUnits(fragment.Systemd.Units); err != nil {
+		c.dn.releaseDrainCoordination(pool)
+		return fmt.Errorf("applying coordinator fragment units: %v", err)
+	}
+
+	// On success the node reboots, so the drain lock and pool pause are
+	// released once it comes back up and completeUpdate runs, the same as
+	// MCD's own update path; only an error here needs us to release now.
+	if err := c.dn.reboot(fmt.Sprintf("coordinator request from %s", holder)); err != nil {
+		c.dn.releaseDrainCoordination(pool)
+		return err
+	}
+	return nil
+}
+
+// Subscribe implements Coordinator.
+func (c *daemonCoordinator) Subscribe() <-chan LifecycleEvent {
+	ch := make(chan LifecycleEvent, 8)
+	c.subMu.Lock()
+	c.subscribers = append(c.subscribers, ch)
+	c.subMu.Unlock()
+	return ch
+}
+
+// publish fans ev out to every current subscriber without blocking on a slow
+// reader.
+func (c *daemonCoordinator) publish(ev LifecycleEvent) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	for _, ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			glog.Warningf("coordinator: subscriber channel full, dropping %s event", ev)
+		}
+	}
+}
+
+func (c *daemonCoordinator) closeSubscribers() {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	for _, ch := range c.subscribers {
+		close(ch)
+	}
+	c.subscribers = nil
+}
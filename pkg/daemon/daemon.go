@@ -7,11 +7,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	imgref "github.com/containers/image/docker/reference"
@@ -22,6 +22,7 @@ import (
 	"github.com/openshift/machine-config-operator/lib/resourceread"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	mcfgclientset "github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned"
 	mcfginformersv1 "github.com/openshift/machine-config-operator/pkg/generated/informers/externalversions/machineconfiguration.openshift.io/v1"
 	mcfglistersv1 "github.com/openshift/machine-config-operator/pkg/generated/listers/machineconfiguration.openshift.io/v1"
 	"github.com/pkg/errors"
@@ -73,12 +74,61 @@ type Daemon struct {
 	mcLister       mcfglistersv1.MachineConfigLister
 	mcListerSynced cache.InformerSynced
 
+	// mcpLister is used to look up the MachineConfigPool that owns this
+	// node, so drain/reboot can be serialized per pool.
+	mcpLister       mcfglistersv1.MachineConfigPoolLister
+	mcpListerSynced cache.InformerSynced
+
+	// mcfgClient allows patching MachineConfigPool objects (e.g. pausing
+	// a pool while this node drains/reboots).
+	mcfgClient mcfgclientset.Interface
+
+	// drainLock is the lease currently held by this node to serialize
+	// drain/reboot against the rest of its pool, if any.
+	drainLock *drainLock
+
+	// updateMu serializes everything that writes on-disk state and
+	// reboots: triggerUpdateWithMachineConfig's own update path and the
+	// Coordinator API's RequestDrainReboot both hold it, since the latter
+	// runs on its own per-connection goroutine and would otherwise race
+	// MCD's own worker goroutine over the same files and reboot call.
+	updateMu sync.Mutex
+
+	// maxUnavailable is the number of nodes in a pool allowed to drain
+	// simultaneously. Enforced by drainLock, which caps the number of
+	// concurrent holders of a pool's drain slot at this value.
+	maxUnavailable int
+
 	// onceFrom defines where the source config is to run the daemon once and exit
 	onceFrom string
 
+	// onceFromDigest optionally pins the expected sha256 content digest
+	// of onceFrom, as an alternative to appending "#sha256=..." to the
+	// URL itself. Every onceFrom transport (http/https, local file,
+	// oci/docker) checks its fetched content against it.
+	onceFromDigest string
+
 	kubeletHealthzEnabled  bool
 	kubeletHealthzEndpoint string
 
+	// healthProbes are polled by runKubeletHealthzMonitor, which only runs
+	// when kubeletHealthzEnabled is set. The kubelet probe is registered
+	// in that case; callers may add more (crio/containerd socket, ovs,
+	// chronyd, ...) via RegisterHealthProbe before Run.
+	healthProbes []HealthProbe
+
+	// coordinator serves the external Coordinator API over a local Unix
+	// socket, letting third-party node-level operators hold off updates
+	// or ask MCD to drain/reboot on their behalf.
+	coordinator *daemonCoordinator
+
+	// signaturePolicyPath, if set, points at a containers/image-style
+	// signature policy used to verify a desired osImageURL's manifest
+	// digest is signedBy a trusted key before we reboot into it. Empty
+	// means use defaultSignaturePolicyPath, and a missing file there
+	// disables verification entirely.
+	signaturePolicyPath string
+
 	installedSigterm bool
 
 	nodeWriter *NodeWriter
@@ -166,6 +216,7 @@ func New(
 	operatingSystem string,
 	nodeUpdaterClient NodeUpdaterClient,
 	onceFrom string,
+	onceFromDigest string,
 	kubeletHealthzEnabled bool,
 	kubeletHealthzEndpoint string,
 	nodeWriter *NodeWriter,
@@ -198,6 +249,7 @@ func New(
 		bootID:                 bootID,
 		bootedOSImageURL:       osImageURL,
 		onceFrom:               onceFrom,
+		onceFromDigest:         onceFromDigest,
 		kubeletHealthzEnabled:  kubeletHealthzEnabled,
 		kubeletHealthzEndpoint: kubeletHealthzEndpoint,
 		nodeWriter:             nodeWriter,
@@ -217,12 +269,16 @@ func NewClusterDrivenDaemon(
 	operatingSystem string,
 	nodeUpdaterClient NodeUpdaterClient,
 	mcInformer mcfginformersv1.MachineConfigInformer,
+	mcpInformer mcfginformersv1.MachineConfigPoolInformer,
 	kubeClient kubernetes.Interface,
+	mcfgClient mcfgclientset.Interface,
 	onceFrom string,
+	onceFromDigest string,
 	nodeInformer coreinformersv1.NodeInformer,
 	kubeletHealthzEnabled bool,
 	kubeletHealthzEndpoint string,
 	nodeWriter *NodeWriter,
+	maxUnavailable int,
 	exitCh chan<- error,
 	stopCh <-chan struct{},
 ) (*Daemon, error) {
@@ -232,6 +288,7 @@ func NewClusterDrivenDaemon(
 		operatingSystem,
 		nodeUpdaterClient,
 		onceFrom,
+		onceFromDigest,
 		kubeletHealthzEnabled,
 		kubeletHealthzEndpoint,
 		nodeWriter,
@@ -244,6 +301,11 @@ func NewClusterDrivenDaemon(
 	}
 
 	dn.kubeClient = kubeClient
+	dn.mcfgClient = mcfgClient
+	if maxUnavailable <= 0 {
+		maxUnavailable = defaultMaxUnavailablePerPool
+	}
+	dn.maxUnavailable = maxUnavailable
 	dn.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "machineconfigdaemon")
 
 	eventBroadcaster := record.NewBroadcaster()
@@ -251,6 +313,17 @@ func NewClusterDrivenDaemon(
 	eventBroadcaster.StartRecordingToSink(&clientsetcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
 	dn.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "machineconfigdaemon", Host: nodeName})
 
+	if kubeletHealthzEnabled {
+		dn.RegisterHealthProbe(newKubeletHealthProbe(
+			kubeletHealthzEndpoint,
+			kubeletHealthzPollingInterval,
+			kubeletHealthzTimeout,
+			kubeletHealthzFailureThreshold,
+			dn.recorder,
+			func() *corev1.Node { return dn.node },
+		))
+	}
+
 	glog.Infof("Managing node: %s", nodeName)
 
 	go dn.runLoginMonitor(dn.stopCh, dn.exitCh)
@@ -262,14 +335,24 @@ func NewClusterDrivenDaemon(
 	dn.nodeListerSynced = nodeInformer.Informer().HasSynced
 	dn.mcLister = mcInformer.Lister()
 	dn.mcListerSynced = mcInformer.Informer().HasSynced
+	dn.mcpLister = mcpInformer.Lister()
+	dn.mcpListerSynced = mcpInformer.Informer().HasSynced
 
 	dn.enqueueNode = dn.enqueueDefault
 	dn.syncHandler = dn.syncNode
 	dn.booting = true
+	dn.coordinator = newCoordinator(dn)
 
 	return dn, nil
 }
 
+// Coordinator returns the daemon's external Coordinator API, letting
+// third-party node-level operators hold off or request updates instead of
+// shipping their own daemonset that fights MCD for drain/reboot.
+func (dn *Daemon) Coordinator() Coordinator {
+	return dn.coordinator
+}
+
 // worker runs a worker thread that just dequeues items, processes them, and marks them done.
 // It enforces that the syncHandler is never invoked concurrently with the same key.
 func (dn *Daemon) worker() {
@@ -336,6 +419,9 @@ func (dn *Daemon) handleErr(err error, key interface{}) {
 	}
 
 	dn.nodeWriter.SetDegraded(err, dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name)
+	if dn.coordinator != nil {
+		dn.coordinator.publish(LifecycleDegraded)
+	}
 
 	utilruntime.HandleError(err)
 	glog.V(2).Infof("Dropping node %q out of the queue: %v", key, err)
@@ -440,6 +526,12 @@ func (dn *Daemon) Run(stopCh <-chan struct{}, exitCh <-chan error) error {
 		go dn.runKubeletHealthzMonitor(stopCh, dn.exitCh)
 	}
 
+	if dn.coordinator != nil && dn.onceFrom == "" {
+		if err := dn.coordinator.Serve(stopCh); err != nil {
+			glog.Warningf("Unable to start coordinator API: %v", err)
+		}
+	}
+
 	// Catch quickly if we've been asked to run once.
 	if dn.onceFrom != "" {
 		genericConfig, configType, contentFrom, err := dn.SenseAndLoadOnceFrom()
@@ -460,7 +552,7 @@ func (dn *Daemon) Run(stopCh <-chan struct{}, exitCh <-chan error) error {
 		}
 	}
 
-	if !cache.WaitForCacheSync(stopCh, dn.nodeListerSynced, dn.mcListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, dn.nodeListerSynced, dn.mcListerSynced, dn.mcpListerSynced) {
 		return errors.New("failed to sync initial listers cache")
 	}
 
@@ -541,57 +633,10 @@ func (dn *Daemon) applySSHAccessedAnnotation() error {
 	return nil
 }
 
-func (dn *Daemon) runKubeletHealthzMonitor(stopCh <-chan struct{}, exitCh chan<- error) {
-	failureCount := 0
-	for {
-		select {
-		case <-stopCh:
-			return
-		case <-time.After(kubeletHealthzPollingInterval):
-			if err := dn.getHealth(); err != nil {
-				glog.Warningf("Failed kubelet health check: %v", err)
-				failureCount++
-				if failureCount >= kubeletHealthzFailureThreshold {
-					exitCh <- fmt.Errorf("kubelet health failure threshold reached")
-				}
-			} else {
-				failureCount = 0 // reset failure count on success
-			}
-		}
-	}
-}
-
-func (dn *Daemon) getHealth() error {
-	glog.V(2).Info("Kubelet health running")
-	ctx, cancel := context.WithTimeout(context.Background(), kubeletHealthzTimeout)
-	defer cancel()
-
-	req, err := http.NewRequest("GET", dn.kubeletHealthzEndpoint, nil)
-	if err != nil {
-		return err
-	}
-	req = req.WithContext(ctx)
-
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	respData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
-	if string(respData) != "ok" {
-		glog.Warningf("Kubelet Healthz Endpoint returned: %s", string(respData))
-		return nil
-	}
-
-	glog.V(2).Info("Kubelet health ok")
-
-	return nil
+// RegisterHealthProbe adds a HealthProbe to be polled by
+// runKubeletHealthzMonitor. Must be called before Run.
+func (dn *Daemon) RegisterHealthProbe(p HealthProbe) {
+	dn.healthProbes = append(dn.healthProbes, p)
 }
 
 // stateAndConfigs is the "state" node annotation plus parsed machine configs
@@ -734,6 +779,12 @@ func (dn *Daemon) CheckStateOnBoot() error {
 		return fmt.Errorf("error detecting previous SSH accesses: %v", err)
 	}
 
+	// Resolve any staged writes left over from a previous run before we
+	// trust the on-disk state enough to validate it.
+	if err := dn.reconcileStagedWrites(); err != nil {
+		return errors.Wrapf(err, "reconciling staged writes")
+	}
+
 	if state.bootstrapping {
 		targetOSImageURL := state.currentConfig.Spec.OSImageURL
 		osMatch, err := dn.checkOS(targetOSImageURL)
@@ -741,6 +792,9 @@ func (dn *Daemon) CheckStateOnBoot() error {
 			return err
 		}
 		if !osMatch {
+			if err := dn.verifySignedOSImage(targetOSImageURL); err != nil {
+				return fmt.Errorf("refusing bootstrap pivot: %v", err)
+			}
 			glog.Infof("Bootstrap pivot required to: %s", targetOSImageURL)
 			// This only returns on error
 			return dn.updateOSAndReboot(state.currentConfig)
@@ -771,10 +825,25 @@ func (dn *Daemon) CheckStateOnBoot() error {
 		expectedConfig = state.currentConfig
 	}
 	if isOnDiskValid := dn.validateOnDiskState(expectedConfig); !isOnDiskValid {
-		return errors.New("unexpected on-disk state")
+		if restoreErr := dn.restoreFromBackups(); restoreErr != nil {
+			glog.Errorf("could not roll back to previous on-disk state: %v", restoreErr)
+			return errors.New("unexpected on-disk state")
+		}
+		glog.Warningf("On-disk state didn't match %s; rolled back to the previous MachineConfig's on-disk state", expectedConfig.GetName())
+		dn.enqueueAfter(dn.node, updateDelay)
+		return nil
 	}
 	glog.Info("Validated on-disk state")
 
+	// Now that the on-disk state has been validated, any write manifest
+	// reconcileStagedWrites left behind for restoreFromBackups to use has
+	// served its purpose; remove it so a later failed validation doesn't
+	// mistakenly roll back to contents this successful update already
+	// superseded.
+	if err := os.Remove(pathWriteManifestJSON); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("failed to remove write manifest after successful validation: %v", err)
+	}
+
 	// We've validated our state.  In the case where we had a pendingConfig,
 	// make that now currentConfig.  We update the node annotation, delete the
 	// state file, etc.
@@ -803,6 +872,9 @@ func (dn *Daemon) CheckStateOnBoot() error {
 			if err := dn.completeUpdate(dn.node, state.pendingConfig.GetName()); err != nil {
 				return err
 			}
+			if dn.coordinator != nil {
+				dn.coordinator.publish(LifecyclePostReboot)
+			}
 		}
 
 		glog.Infof("In desired config %s", state.currentConfig.GetName())
@@ -848,8 +920,10 @@ func (dn *Daemon) runOnceFromMachineConfig(machineConfig mcfgv1.MachineConfig, c
 
 // runOnceFromIgnition executes MCD's subset of Ignition functionality in onceFrom mode
 func (dn *Daemon) runOnceFromIgnition(ignConfig ignv2_2types.Config) error {
-	// Execute update without hitting the cluster
-	if err := dn.writeFiles(ignConfig.Storage.Files); err != nil {
+	// Execute update without hitting the cluster. A bare Ignition config
+	// carries no machineconfiguration.openshift.io annotations, so there's
+	// no fileSecurityContext to restore here.
+	if err := dn.writeFiles(ignConfig.Storage.Files, nil); err != nil {
 		return err
 	}
 	if err := dn.writeUnits(ignConfig.Systemd.Units); err != nil {
@@ -887,6 +961,58 @@ func (dn *Daemon) prepUpdateFromCluster() (bool, error) {
 		glog.V(2).Info("No updating is required")
 		return false, nil
 	}
+
+	desiredConfig, err := dn.mcLister.Get(desiredConfigName)
+	if err != nil {
+		return false, err
+	}
+	skipped, err := dn.skipUpdateIfOnDiskStateMatches(desiredConfig)
+	if err != nil {
+		return false, err
+	}
+	if skipped {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// skipUpdateIfOnDiskStateMatches handles the common case where a
+// MachineConfig was regenerated with identical rendered content (e.g. a
+// controller re-render, or an MCO upgrade producing the same output): if
+// every file, unit, kernelArg, SSH key, and the booted osImageURL already
+// match desiredConfig, there's nothing to drain or reboot for. We just
+// fast-forward the currentConfig annotation to desiredConfig, make sure the
+// node is schedulable, and record a no-op Event rather than disrupting the
+// node.
+func (dn *Daemon) skipUpdateIfOnDiskStateMatches(desiredConfig *mcfgv1.MachineConfig) (bool, error) {
+	if dn.OperatingSystem == machineConfigDaemonOSRHCOS {
+		// Re-query the booted osImageURL rather than trusting the value
+		// cached at startup, since it's the one thing on-disk state
+		// checks alone can't catch (e.g. a pivot performed outside MCD).
+		bootedOSImageURL, _, err := dn.NodeUpdaterClient.GetBootedOSImageURL(dn.rootMount)
+		if err != nil {
+			return false, errors.Wrapf(err, "refreshing booted osImageURL")
+		}
+		dn.bootedOSImageURL = bootedOSImageURL
+	}
+
+	if !dn.validateOnDiskState(desiredConfig) {
+		return false, nil
+	}
+
+	glog.Infof("On-disk state already matches desired config %s; skipping drain/reboot", desiredConfig.GetName())
+
+	if err := drain.Uncordon(dn.kubeClient.CoreV1().Nodes(), dn.node, nil); err != nil {
+		return false, err
+	}
+	if err := dn.nodeWriter.SetUpdateDone(dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name, desiredConfig.GetName()); err != nil {
+		return false, err
+	}
+	if dn.recorder != nil {
+		dn.recorder.Eventf(dn.node, corev1.EventTypeNormal, "NoopReconcile", "on-disk state already matched MachineConfig %s; skipped drain/reboot", desiredConfig.GetName())
+	}
+
 	return true, nil
 }
 
@@ -898,6 +1024,12 @@ func (dn *Daemon) completeUpdate(node *corev1.Node, desiredConfigName string) er
 		return err
 	}
 
+	if pool, err := dn.getPoolForNode(); err != nil {
+		glog.Warningf("could not find pool for node %s to release drain coordination: %v", dn.name, err)
+	} else {
+		dn.releaseDrainCoordination(pool)
+	}
+
 	dn.logSystem("machine-config-daemon: completed update for config %s", desiredConfigName)
 
 	return nil
@@ -928,8 +1060,44 @@ func (dn *Daemon) triggerUpdateWithMachineConfig(currentConfig *mcfgv1.MachineCo
 		}
 	}
 
-	// run the update process. this function doesn't currently return.
-	return dn.update(currentConfig, desiredConfig)
+	if desiredConfig.Spec.OSImageURL != currentConfig.Spec.OSImageURL {
+		if err := dn.verifySignedOSImage(desiredConfig.Spec.OSImageURL); err != nil {
+			return fmt.Errorf("refusing osImageURL update: %v", err)
+		}
+	}
+
+	if dn.coordinator != nil {
+		if held, by := dn.coordinator.isHeld(); held {
+			glog.Infof("Deferring update: held by %s", by)
+			dn.enqueueAfter(dn.node, updateDelay)
+			return nil
+		}
+	}
+
+	pool, err := dn.coordinateDrain()
+	if err != nil {
+		return fmt.Errorf("coordinating drain/reboot with pool: %v", err)
+	}
+
+	if dn.coordinator != nil {
+		dn.coordinator.publish(LifecyclePreDrain)
+	}
+
+	// updateMu keeps this critical section from ever running concurrently
+	// with a coordinator-requested drain/reboot (see RequestDrainReboot),
+	// which would otherwise race over the same files and reboot call.
+	dn.updateMu.Lock()
+	defer dn.updateMu.Unlock()
+
+	// run the update process. this function doesn't currently return on
+	// success (the node reboots); if it returns with an error the pool
+	// must be unpaused and the lock released so other nodes aren't stuck
+	// waiting behind our failed attempt.
+	if err := dn.update(currentConfig, desiredConfig); err != nil {
+		dn.releaseDrainCoordination(pool)
+		return err
+	}
+	return nil
 }
 
 // validateOnDiskState compares the on-disk state against what a configuration
@@ -947,13 +1115,25 @@ func (dn *Daemon) validateOnDiskState(currentConfig *mcfgv1.MachineConfig) bool
 		glog.Errorf("expected target osImageURL %s", currentConfig.Spec.OSImageURL)
 		return false
 	}
+	securityContexts, err := securityContextsFromConfig(currentConfig)
+	if err != nil {
+		glog.Errorf("%s", err)
+		return false
+	}
+
 	// And the rest of the disk state
-	if !checkFiles(currentConfig.Spec.Config.Storage.Files) {
+	if !checkFiles(currentConfig.Spec.Config.Storage.Files, securityContexts) {
 		return false
 	}
 	if !checkUnits(currentConfig.Spec.Config.Systemd.Units) {
 		return false
 	}
+	if !checkKernelArguments(currentConfig.Spec.KernelArguments) {
+		return false
+	}
+	if !checkSSHKeys(currentConfig.Spec.Config.Passwd.Users) {
+		return false
+	}
 	return true
 }
 
@@ -1056,9 +1236,10 @@ func checkUnits(units []ignv2_2types.Unit) bool {
 	return true
 }
 
-// checkFiles validates the contents of  all the files in the
-// target config.
-func checkFiles(files []ignv2_2types.File) bool {
+// checkFiles validates the contents of all the files in the target config,
+// plus, for any path with an entry in securityContexts, its SELinux label
+// and security-relevant xattrs.
+func checkFiles(files []ignv2_2types.File, securityContexts map[string]fileSecurityContext) bool {
 	checkedFiles := make(map[string]bool)
 	for i := len(files) - 1; i >= 0; i-- {
 		f := files[i]
@@ -1078,6 +1259,11 @@ func checkFiles(files []ignv2_2types.File) bool {
 		if status := checkFileContentsAndMode(f.Path, contents.Data, mode); !status {
 			return false
 		}
+		if ctx, ok := securityContexts[f.Path]; ok {
+			if status := checkSecurityContext(f.Path, ctx); !status {
+				return false
+			}
+		}
 		checkedFiles[f.Path] = true
 	}
 	return true
@@ -1128,34 +1314,25 @@ func ValidPath(path string) bool {
 // parses to verify the type, and returns back the genericInterface, the type description,
 // if it was local or remote, and error.
 func (dn *Daemon) SenseAndLoadOnceFrom() (interface{}, string, string, error) {
-	var content []byte
-	var err error
-	var contentFrom string
-	// Read the content from a remote endpoint if requested
-	if strings.HasPrefix(dn.onceFrom, "http://") || strings.HasPrefix(dn.onceFrom, "https://") {
+	url, pinnedDigest := splitOnceFromDigest(dn.onceFrom)
+	if pinnedDigest == "" {
+		pinnedDigest = dn.onceFromDigest
+	}
+
+	scheme := schemeOf(url)
+	contentFrom := machineConfigOnceFromLocalConfig
+	if scheme != "file" {
 		contentFrom = machineConfigOnceFromRemoteConfig
-		resp, err := http.Get(dn.onceFrom)
-		if err != nil {
-			return nil, "", contentFrom, err
-		}
-		defer resp.Body.Close()
-		// Read the body content from the request
-		content, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, "", contentFrom, err
-		}
-	} else {
-		// Otherwise read it from a local file
-		contentFrom = machineConfigOnceFromLocalConfig
-		absoluteOnceFrom, err := filepath.Abs(filepath.Clean(dn.onceFrom))
-		if err != nil {
-			return nil, "", contentFrom, err
-		}
+	}
 
-		content, err = ioutil.ReadFile(absoluteOnceFrom)
-		if err != nil {
-			return nil, "", contentFrom, err
-		}
+	newTransport, ok := transportRegistry[scheme]
+	if !ok {
+		return nil, "", contentFrom, fmt.Errorf("unsupported onceFrom source %q: no transport registered for scheme %q", dn.onceFrom, scheme)
+	}
+
+	content, err := newTransport(dn).Fetch(context.Background(), url, pinnedDigest)
+	if err != nil {
+		return nil, "", contentFrom, err
 	}
 
 	// Try each supported parser
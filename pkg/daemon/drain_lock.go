@@ -0,0 +1,272 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	coordv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// drainLockNamespace is where per-pool coordination Leases live.
+	drainLockNamespace = "openshift-machine-config-operator"
+
+	// drainLockLeaseDuration is how long a held slot is valid before
+	// another node may consider it expired and steal it.
+	drainLockLeaseDuration = 5 * time.Minute
+
+	// drainLockRetryInterval is the base backoff between attempts to
+	// acquire a slot that's currently full.
+	drainLockRetryInterval = 5 * time.Second
+
+	// drainLockMaxRetryInterval caps the exponential backoff above.
+	drainLockMaxRetryInterval = 2 * time.Minute
+
+	// defaultMaxUnavailablePerPool is used when a pool hasn't been given
+	// an explicit --max-unavailable-per-pool override. It's intentionally
+	// conservative: serialize one node's disruption at a time.
+	defaultMaxUnavailablePerPool = 1
+
+	// drainLockHoldersAnnotation holds a JSON-encoded map[holder]RFC3339
+	// acquire-time of every node currently occupying a drain slot for this
+	// pool. A coordination.k8s.io Lease only has room for a single
+	// HolderIdentity/RenewTime pair, which can't represent more than one
+	// concurrent holder, so (mirroring how fileSecurityContext is threaded
+	// through an annotation in security_context_check.go) we keep the real
+	// set of holders here. RenewTime/LeaseDurationSeconds on the Lease are
+	// left unused, and HolderIdentity is only set for display when the
+	// Lease is created (see newLeaseWithHolders).
+	drainLockHoldersAnnotation = "machineconfiguration.openshift.io/drain-holders"
+)
+
+// drainLock serializes node drain/reboot across the nodes of a single
+// MachineConfigPool, allowing up to maxUnavailable nodes to hold a slot at
+// once. It uses a coordination.k8s.io Lease purely as the object to CAS
+// updates against; the actual holder set lives in drainLockHoldersAnnotation
+// (see its doc comment). This mirrors the MCP-pause lock the
+// sriov-network-operator config daemon grew to avoid racing MCO's own
+// drains, generalized from a single mutual-exclusion holder to N.
+type drainLock struct {
+	kubeClient     kubernetes.Interface
+	poolName       string
+	holder         string
+	maxUnavailable int
+}
+
+// newDrainLock returns a lock scoped to the given MachineConfigPool, allowing
+// up to maxUnavailable nodes to hold a slot concurrently. holder should
+// uniquely identify this node (its name is sufficient). maxUnavailable <= 0
+// is treated as defaultMaxUnavailablePerPool.
+func newDrainLock(kubeClient kubernetes.Interface, poolName, holder string, maxUnavailable int) *drainLock {
+	if maxUnavailable <= 0 {
+		maxUnavailable = defaultMaxUnavailablePerPool
+	}
+	return &drainLock{
+		kubeClient:     kubeClient,
+		poolName:       poolName,
+		holder:         holder,
+		maxUnavailable: maxUnavailable,
+	}
+}
+
+func (l *drainLock) leaseName() string {
+	return fmt.Sprintf("mcd-drain-%s", l.poolName)
+}
+
+// Acquire blocks, retrying with exponential backoff, until this node holds
+// one of the pool's slots: either it already held one, or fewer than
+// maxUnavailable unexpired holders remain. It gives up if stopCh is closed
+// first.
+func (l *drainLock) Acquire(stopCh <-chan struct{}) error {
+	backoff := wait.Backoff{
+		Duration: drainLockRetryInterval,
+		Factor:   2,
+		Steps:    math.MaxInt32,
+		Cap:      drainLockMaxRetryInterval,
+	}
+	return wait.ExponentialBackoff(backoff, func() (bool, error) {
+		select {
+		case <-stopCh:
+			return false, errors.New("drain lock acquisition cancelled")
+		default:
+		}
+		acquired, err := l.tryAcquire()
+		if err != nil {
+			glog.Warningf("drain lock: error acquiring lease %s/%s: %v", drainLockNamespace, l.leaseName(), err)
+			return false, nil
+		}
+		if !acquired {
+			glog.Infof("drain lock: lease %s/%s is held by another node, waiting", drainLockNamespace, l.leaseName())
+			return false, nil
+		}
+		glog.Infof("drain lock: acquired lease %s/%s", drainLockNamespace, l.leaseName())
+		return true, nil
+	})
+}
+
+func (l *drainLock) tryAcquire() (bool, error) {
+	leases := l.kubeClient.CoordinationV1().Leases(drainLockNamespace)
+	now := time.Now()
+
+	existing, err := leases.Get(context.TODO(), l.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease, encodeErr := l.newLeaseWithHolders(drainHolders{l.holder: now})
+		if encodeErr != nil {
+			return false, encodeErr
+		}
+		_, createErr := leases.Create(context.TODO(), lease, metav1.CreateOptions{})
+		if createErr != nil {
+			if apierrors.IsAlreadyExists(createErr) {
+				return false, nil
+			}
+			return false, createErr
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holders, err := decodeDrainHolders(existing)
+	if err != nil {
+		return false, err
+	}
+	holders = holders.withoutExpired(now)
+
+	if _, alreadyHeld := holders[l.holder]; alreadyHeld {
+		// We already hold a slot, e.g. retrying after a daemon restart; renew it.
+		holders[l.holder] = now
+	} else {
+		if len(holders) >= l.maxUnavailable {
+			return false, nil
+		}
+		holders[l.holder] = now
+	}
+
+	if err := setDrainHolders(existing, holders); err != nil {
+		return false, err
+	}
+	_, err = leases.Update(context.TODO(), existing, metav1.UpdateOptions{})
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Release gives up this node's slot so another node waiting on the pool's
+// maxUnavailable limit can proceed. The Lease itself is deleted once the
+// last holder releases. remaining is the number of other holders still
+// occupying a slot after this release, which callers use to decide whether
+// it's safe to undo anything gated on "some node in this pool is
+// disrupting it" (e.g. unpausing the pool).
+func (l *drainLock) Release() (remaining int, err error) {
+	leases := l.kubeClient.CoordinationV1().Leases(drainLockNamespace)
+	existing, err := leases.Get(context.TODO(), l.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	holders, err := decodeDrainHolders(existing)
+	if err != nil {
+		return 0, err
+	}
+	if _, held := holders[l.holder]; !held {
+		// Already reclaimed by someone else (e.g. our slot expired); report
+		// the holder set as it stands rather than assuming we're the last.
+		return len(holders), nil
+	}
+	delete(holders, l.holder)
+
+	if len(holders) == 0 {
+		return 0, leases.Delete(context.TODO(), l.leaseName(), metav1.DeleteOptions{})
+	}
+	if err := setDrainHolders(existing, holders); err != nil {
+		return 0, err
+	}
+	_, err = leases.Update(context.TODO(), existing, metav1.UpdateOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return len(holders), nil
+}
+
+// drainHolders maps a holder (node) name to the time it most recently
+// acquired or renewed its slot, and is the decoded form of
+// drainLockHoldersAnnotation.
+type drainHolders map[string]time.Time
+
+// withoutExpired returns a copy of h with any holder whose slot has aged
+// past drainLockLeaseDuration removed, so a node that died without
+// releasing doesn't permanently occupy one of maxUnavailable slots.
+func (h drainHolders) withoutExpired(now time.Time) drainHolders {
+	live := make(drainHolders, len(h))
+	for holder, acquired := range h {
+		if now.Before(acquired.Add(drainLockLeaseDuration)) {
+			live[holder] = acquired
+		}
+	}
+	return live
+}
+
+// decodeDrainHolders parses lease's drainLockHoldersAnnotation. A Lease with
+// no such annotation (e.g. one created by an older MCD) is treated as having
+// no holders.
+func decodeDrainHolders(lease *coordv1.Lease) (drainHolders, error) {
+	raw, ok := lease.Annotations[drainLockHoldersAnnotation]
+	if !ok || raw == "" {
+		return drainHolders{}, nil
+	}
+	var holders drainHolders
+	if err := json.Unmarshal([]byte(raw), &holders); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s annotation", drainLockHoldersAnnotation)
+	}
+	return holders, nil
+}
+
+// setDrainHolders JSON-encodes holders into lease's drainLockHoldersAnnotation.
+func setDrainHolders(lease *coordv1.Lease, holders drainHolders) error {
+	raw, err := json.Marshal(holders)
+	if err != nil {
+		return errors.Wrap(err, "encoding drain holders")
+	}
+	if lease.Annotations == nil {
+		lease.Annotations = make(map[string]string, 1)
+	}
+	lease.Annotations[drainLockHoldersAnnotation] = string(raw)
+	return nil
+}
+
+// newLeaseWithHolders builds the Lease object used the first time a pool's
+// drain lock is acquired. HolderIdentity is set to the first holder purely
+// so `kubectl get lease` shows something meaningful; drainLockHoldersAnnotation
+// remains the source of truth for how many slots are in use.
+func (l *drainLock) newLeaseWithHolders(holders drainHolders) (*coordv1.Lease, error) {
+	lease := &coordv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      l.leaseName(),
+			Namespace: drainLockNamespace,
+		},
+		Spec: coordv1.LeaseSpec{
+			HolderIdentity: &l.holder,
+		},
+	}
+	if err := setDrainHolders(lease, holders); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+)
+
+const (
+	// pathProcCmdline is the currently booted kernel's command line, used
+	// to check that a MachineConfig's kernelArguments actually took
+	// effect, since those only ever land by way of a reboot.
+	pathProcCmdline = "/proc/cmdline"
+
+	// coreUserName is the only user atomicallyWriteSSHKey manages; other
+	// usernames in a MachineConfig's Passwd.Users aren't supported by the
+	// write path, so checkSSHKeys ignores them too.
+	coreUserName = "core"
+
+	// sshKeyPath is where MCD writes coreUserName's MachineConfig-managed
+	// authorized keys; see atomicallyWriteSSHKey.
+	sshKeyPath = "/home/core/.ssh/authorized_keys.d/ignition"
+)
+
+// checkKernelArguments verifies every argument in kernelArguments is
+// present on the booted kernel command line. It doesn't flag unexpected
+// extra arguments, mirroring checkFiles/checkUnits' one-directional "does
+// the booted state satisfy what's desired" comparison.
+func checkKernelArguments(kernelArguments []string) bool {
+	if len(kernelArguments) == 0 {
+		return true
+	}
+	cmdline, err := ioutil.ReadFile(pathProcCmdline)
+	if err != nil {
+		glog.Errorf("state validation: could not read %s: %v", pathProcCmdline, err)
+		return false
+	}
+	booted := make(map[string]bool)
+	for _, arg := range strings.Fields(string(cmdline)) {
+		booted[arg] = true
+	}
+	for _, arg := range kernelArguments {
+		if !booted[arg] {
+			glog.Errorf("state validation: kernel argument %q is not present on the booted kernel command line", arg)
+			return false
+		}
+	}
+	return true
+}
+
+// checkSSHKeys verifies coreUserName's on-disk authorized_keys file
+// matches the SSHAuthorizedKeys users specifies, so a config change that
+// only rotates SSH keys isn't mistaken for one already applied.
+func checkSSHKeys(users []ignv2_2types.PasswdUser) bool {
+	for _, u := range users {
+		if u.Name != coreUserName {
+			continue
+		}
+		expected := sshAuthorizedKeysBlob(u.SSHAuthorizedKeys)
+
+		actual, err := ioutil.ReadFile(sshKeyPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				actual = nil
+			} else {
+				glog.Errorf("state validation: could not read %s: %v", sshKeyPath, err)
+				return false
+			}
+		}
+
+		if string(actual) != expected {
+			glog.Errorf("state validation: SSH authorized_keys for %q does not match expected content", u.Name)
+			return false
+		}
+	}
+	return true
+}
+
+// sshAuthorizedKeysBlob renders keys the same way atomicallyWriteSSHKey
+// writes them to sshKeyPath: one key per line, newline-terminated.
+func sshAuthorizedKeysBlob(keys []ignv2_2types.SSHAuthorizedKey) string {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(string(k))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,272 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// HealthProbe is implemented by anything the daemon should poll
+// periodically as part of node-local health monitoring. In addition to the
+// kubelet itself, operators can register probes for adjacent subsystems
+// (crio/containerd socket, ovs, chronyd, ...) via Daemon.RegisterHealthProbe
+// once NewClusterDrivenDaemon has returned.
+type HealthProbe interface {
+	// Name identifies the probe in logs, Events and metrics.
+	Name() string
+	// Check runs one poll of the probe, returning an error if it's unhealthy.
+	Check(ctx context.Context) error
+	// Interval is how often Check should be called.
+	Interval() time.Duration
+	// FailureThreshold is how many consecutive failures are tolerated
+	// before the daemon treats the probe as down.
+	FailureThreshold() int
+}
+
+// subsystemStatus is the per-subsystem health the kubelet reports at
+// /healthz?verbose=1, one line per subsystem in the form "[+]name ok" or
+// "[-]name failed: reason".
+type subsystemStatus struct {
+	name    string
+	healthy bool
+	detail  string
+}
+
+// kubeletHealthProbe polls the kubelet's healthz family of endpoints,
+// parsing response bodies rather than trusting status codes alone, and
+// tracks which named subsystem (etcd, syncloop, ping, log) is responsible
+// for a failure so the daemon can react more precisely than "restart
+// everything".
+type kubeletHealthProbe struct {
+	endpoint   string
+	client     *http.Client
+	interval   time.Duration
+	timeout    time.Duration
+	threshold  int
+	recorder   record.EventRecorder
+	node       func() *corev1.Node
+	remediate  func() error
+	cooldown   time.Duration
+	lastRemedy time.Time
+}
+
+// newKubeletHealthProbe builds the default kubelet HealthProbe. endpoint is
+// the kubelet's base healthz URL, e.g. "http://localhost:10248".
+func newKubeletHealthProbe(endpoint string, interval, timeout time.Duration, threshold int, recorder record.EventRecorder, node func() *corev1.Node) *kubeletHealthProbe {
+	// Historically dn.kubeletHealthzEndpoint pointed directly at
+	// ".../healthz"; tolerate that so existing --kubelet-healthz-endpoint
+	// flag values keep working against the new, multi-endpoint probe.
+	endpoint = strings.TrimSuffix(endpoint, "/healthz")
+	return &kubeletHealthProbe{
+		endpoint:  endpoint,
+		client:    &http.Client{},
+		interval:  interval,
+		timeout:   timeout,
+		threshold: threshold,
+		recorder:  recorder,
+		node:      node,
+		cooldown:  10 * time.Minute,
+		remediate: remediateKubeletSyncloop,
+	}
+}
+
+func (p *kubeletHealthProbe) Name() string           { return "kubelet" }
+func (p *kubeletHealthProbe) Interval() time.Duration { return p.interval }
+func (p *kubeletHealthProbe) FailureThreshold() int   { return p.threshold }
+
+// Check polls /healthz, /healthz/syncloop and /healthz/log individually
+// (each can fail independently), then parses /healthz?verbose=1 to record
+// per-subsystem detail. It returns an error describing every subsystem that
+// failed.
+func (p *kubeletHealthProbe) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var failed []string
+
+	for _, path := range []string{"/healthz", "/healthz/syncloop", "/healthz/log"} {
+		body, err := p.get(ctx, path)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if strings.TrimSpace(body) != "ok" {
+			failed = append(failed, fmt.Sprintf("%s: %s", path, strings.TrimSpace(body)))
+		}
+	}
+
+	statuses, err := p.verboseStatus(ctx)
+	if err != nil {
+		glog.Warningf("kubelet health: could not fetch verbose subsystem status: %v", err)
+	}
+	for _, s := range statuses {
+		if !s.healthy {
+			p.recordSubsystemFailure(s)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	if onlySyncloopFailing(failed) {
+		p.maybeRemediate()
+	}
+
+	return fmt.Errorf("kubelet healthz failures: %s", strings.Join(failed, "; "))
+}
+
+func (p *kubeletHealthProbe) get(ctx context.Context, path string) (string, error) {
+	req, err := http.NewRequest("GET", p.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// verboseStatus fetches /healthz?verbose=1 and parses each "[+]name ok" or
+// "[-]name failed: detail" line into a subsystemStatus.
+func (p *kubeletHealthProbe) verboseStatus(ctx context.Context) ([]subsystemStatus, error) {
+	body, err := p.get(ctx, "/healthz?verbose=1")
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []subsystemStatus
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "[+]") && !strings.HasPrefix(line, "[-]") {
+			continue
+		}
+		healthy := strings.HasPrefix(line, "[+]")
+		rest := line[3:]
+		name := rest
+		detail := ""
+		if idx := strings.Index(rest, " "); idx >= 0 {
+			name = rest[:idx]
+			detail = strings.TrimSpace(rest[idx+1:])
+		}
+		statuses = append(statuses, subsystemStatus{name: name, healthy: healthy, detail: detail})
+	}
+	return statuses, scanner.Err()
+}
+
+func (p *kubeletHealthProbe) recordSubsystemFailure(s subsystemStatus) {
+	glog.Warningf("kubelet health: subsystem %q unhealthy: %s", s.name, s.detail)
+	if p.recorder == nil || p.node == nil {
+		return
+	}
+	node := p.node()
+	if node == nil {
+		return
+	}
+	p.recorder.Eventf(node, corev1.EventTypeWarning, "KubeletSubsystemUnhealthy", "kubelet subsystem %q is unhealthy: %s", s.name, s.detail)
+}
+
+// maybeRemediate attempts a scoped fix when only the syncloop subsystem is
+// failing, respecting a cool-down so we don't thrash systemctl restarts.
+func (p *kubeletHealthProbe) maybeRemediate() {
+	if p.remediate == nil {
+		return
+	}
+	if time.Since(p.lastRemedy) < p.cooldown {
+		return
+	}
+	glog.Warningf("kubelet health: only the syncloop subsystem is failing; attempting scoped remediation")
+	if err := p.remediate(); err != nil {
+		glog.Errorf("kubelet health: scoped remediation failed: %v", err)
+		return
+	}
+	p.lastRemedy = time.Now()
+}
+
+func onlySyncloopFailing(failed []string) bool {
+	if len(failed) == 0 {
+		return false
+	}
+	for _, f := range failed {
+		if !strings.HasPrefix(f, "/healthz/syncloop") {
+			return false
+		}
+	}
+	return true
+}
+
+// remediateKubeletSyncloop restarts the kubelet unit; it's the scoped
+// remediation attempted before falling back to a full exitCh-triggered
+// reboot.
+func remediateKubeletSyncloop() error {
+	return exec.Command("systemctl", "restart", "kubelet").Run()
+}
+
+// runKubeletHealthzMonitor polls every registered HealthProbe at its own
+// interval, tracking consecutive failures per probe. A probe that reaches
+// its FailureThreshold reports to exitCh.
+func (dn *Daemon) runKubeletHealthzMonitor(stopCh <-chan struct{}, exitCh chan<- error) {
+	failureCounts := make(map[string]int)
+	tickers := make(map[string]*time.Ticker)
+	cases := make(chan string)
+
+	for _, p := range dn.healthProbes {
+		p := p
+		t := time.NewTicker(p.Interval())
+		tickers[p.Name()] = t
+		go func() {
+			for range t.C {
+				select {
+				case cases <- p.Name():
+				case <-stopCh:
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		for _, t := range tickers {
+			t.Stop()
+		}
+	}()
+
+	probesByName := make(map[string]HealthProbe, len(dn.healthProbes))
+	for _, p := range dn.healthProbes {
+		probesByName[p.Name()] = p
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case name := <-cases:
+			p := probesByName[name]
+			if err := p.Check(context.Background()); err != nil {
+				glog.Warningf("Failed health check for %s: %v", name, err)
+				failureCounts[name]++
+				if failureCounts[name] >= p.FailureThreshold() {
+					exitCh <- fmt.Errorf("%s health failure threshold reached: %v", name, err)
+				}
+			} else {
+				failureCounts[name] = 0
+			}
+		}
+	}
+}
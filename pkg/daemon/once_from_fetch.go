@@ -0,0 +1,122 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// onceFromMaxBodyBytes bounds how much we'll read from a remote
+	// --once-from URL, so a misbehaving or compromised server can't make
+	// the bootstrap daemon exhaust memory.
+	onceFromMaxBodyBytes = 10 * 1024 * 1024
+
+	// onceFromFetchRetries is the total number of fetch attempts made
+	// before giving up.
+	onceFromFetchRetries = 5
+	// onceFromFetchBackoff is the base delay between retries.
+	onceFromFetchBackoff = 2 * time.Second
+
+	// onceFromDigestSeparator splits a pinned content digest off the end
+	// of a --once-from URL, e.g. "https://host/mc.ign#sha256=abcd...".
+	onceFromDigestSeparator = "#sha256="
+)
+
+// splitOnceFromDigest extracts a digest pinned via the "#sha256=..." URL
+// grammar, if present, returning the bare URL and the lowercase hex digest.
+func splitOnceFromDigest(rawURL string) (url string, digest string) {
+	if idx := strings.Index(rawURL, onceFromDigestSeparator); idx >= 0 {
+		return rawURL[:idx], strings.ToLower(rawURL[idx+len(onceFromDigestSeparator):])
+	}
+	return rawURL, ""
+}
+
+// fetchVerifiedOnceFrom retrieves url's content, retrying transient errors
+// with backoff, while computing its sha256 digest as it streams through a
+// digesting reader rather than buffering then re-reading. If pinnedDigest
+// is non-empty, the computed digest must match it exactly; a mismatch
+// fails closed; we never fall back to trusting unverified content.
+func fetchVerifiedOnceFrom(url, pinnedDigest string) ([]byte, error) {
+	var content []byte
+	backoff := wait.Backoff{
+		Duration: onceFromFetchBackoff,
+		Factor:   2,
+		Steps:    onceFromFetchRetries,
+	}
+
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		body, digest, err := fetchOnce(url)
+		if err != nil {
+			glog.Warningf("onceFrom: fetch of %s failed, will retry: %v", url, err)
+			return false, nil
+		}
+		if pinnedDigest != "" && digest != pinnedDigest {
+			// A verification failure is not transient: retrying against
+			// the same (wrong) content would just fail again, and we
+			// must never fall back to the unverified bytes.
+			return false, fmt.Errorf("content digest mismatch for %s: expected sha256:%s, got sha256:%s", url, pinnedDigest, digest)
+		}
+		content = body
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// fetchOnce performs a single GET of url, streaming the response body
+// through a digesting TeeReader capped at onceFromMaxBodyBytes, and returns
+// both the content and its hex sha256 digest.
+func fetchOnce(url string) ([]byte, string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s fetching %s", resp.Status, url)
+	}
+
+	hasher := sha256.New()
+	limited := io.LimitReader(resp.Body, onceFromMaxBodyBytes+1)
+	tee := io.TeeReader(limited, hasher)
+
+	content, err := ioutil.ReadAll(tee)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "reading body of %s", url)
+	}
+	if len(content) > onceFromMaxBodyBytes {
+		return nil, "", fmt.Errorf("body of %s exceeds %d byte limit", url, onceFromMaxBodyBytes)
+	}
+
+	return content, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// readLocalOnceFrom reads a local --once-from path and returns its content
+// alongside the content's hex sha256 digest, so fileTransport can verify a
+// pinned digest the same way httpTransport does for remote URLs.
+func readLocalOnceFrom(path string) ([]byte, string, error) {
+	absPath, err := filepath.Abs(filepath.Clean(path))
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Transport fetches the raw bytes of a --once-from target. Implementations
+// are registered by URL scheme in transportRegistry so SenseAndLoadOnceFrom
+// doesn't need to know ahead of time whether dn.onceFrom names a plain
+// HTTP(S) URL, a local path, or an OCI/registry reference.
+type Transport interface {
+	// Fetch retrieves ref's content. pinnedDigest, if non-empty, is the
+	// expected sha256 content digest; implementations must fail closed
+	// rather than return unverified content when it doesn't match.
+	Fetch(ctx context.Context, ref, pinnedDigest string) ([]byte, error)
+}
+
+// transportFactory builds a Transport scoped to dn's configuration (e.g.
+// its signature policy), so a single registry entry can still carry
+// per-daemon settings.
+type transportFactory func(dn *Daemon) Transport
+
+// transportRegistry maps a --once-from URL scheme to the factory that
+// handles it. "file" is used for bare local paths, which carry no scheme.
+var transportRegistry = map[string]transportFactory{
+	"http":   func(*Daemon) Transport { return httpTransport{} },
+	"https":  func(*Daemon) Transport { return httpTransport{} },
+	"file":   func(*Daemon) Transport { return fileTransport{} },
+	"oci":    newOCITransport,
+	"docker": newOCITransport,
+}
+
+// RegisterTransport adds or replaces the Transport factory used for scheme.
+// It exists so a future --once-from source (e.g. an s3:// bucket) can be
+// added without SenseAndLoadOnceFrom itself changing.
+func RegisterTransport(scheme string, factory func(dn *Daemon) Transport) {
+	transportRegistry[scheme] = factory
+}
+
+// schemeOf returns ref's URL scheme, or "file" if ref has none, matching
+// the bare-path convention --once-from already uses for local files.
+func schemeOf(ref string) string {
+	if idx := strings.Index(ref, "://"); idx >= 0 {
+		return ref[:idx]
+	}
+	return "file"
+}
+
+// httpTransport fetches a --once-from target over plain HTTP(S), reusing
+// the streaming-digest fetch logic already used to pin remote content.
+type httpTransport struct{}
+
+func (httpTransport) Fetch(_ context.Context, ref, pinnedDigest string) ([]byte, error) {
+	return fetchVerifiedOnceFrom(ref, pinnedDigest)
+}
+
+// fileTransport fetches a --once-from target from the local filesystem.
+type fileTransport struct{}
+
+func (fileTransport) Fetch(_ context.Context, ref, pinnedDigest string) ([]byte, error) {
+	content, digest, err := readLocalOnceFrom(ref)
+	if err != nil {
+		return nil, err
+	}
+	if pinnedDigest != "" && digest != pinnedDigest {
+		return nil, fmt.Errorf("content digest mismatch for %s: expected sha256:%s, got sha256:%s", ref, pinnedDigest, digest)
+	}
+	return content, nil
+}
@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// poolUpdatedPollInterval is how often we re-check a pool's Updated
+	// condition while waiting for another in-flight update to finish.
+	poolUpdatedPollInterval = 10 * time.Second
+
+	// poolUpdatedTimeout bounds how long we'll wait for a pool to report
+	// Updated=True before giving up and degrading.
+	poolUpdatedTimeout = 30 * time.Minute
+)
+
+// getPoolForNode returns the MachineConfigPool that owns dn.node, matching
+// the same label-selector semantics the controller uses to assign nodes to
+// pools. It returns an error if no pool claims the node.
+func (dn *Daemon) getPoolForNode() (*mcfgv1.MachineConfigPool, error) {
+	pools, err := dn.mcpLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	nodeLabels := labels.Set(dn.node.Labels)
+	for _, pool := range pools {
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.NodeSelector)
+		if err != nil {
+			glog.Warningf("invalid node selector on pool %s: %v", pool.Name, err)
+			continue
+		}
+		if selector.Matches(nodeLabels) {
+			return pool, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find a MachineConfigPool for node %s", dn.name)
+}
+
+// waitForPoolUpdated blocks until the given pool's Updated condition is
+// True, meaning no other node-level update is currently in flight for it.
+func (dn *Daemon) waitForPoolUpdated(pool *mcfgv1.MachineConfigPool) error {
+	return wait.PollImmediate(poolUpdatedPollInterval, poolUpdatedTimeout, func() (bool, error) {
+		current, err := dn.mcpLister.Get(pool.Name)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range current.Status.Conditions {
+			if c.Type == mcfgv1.MachineConfigPoolUpdated {
+				return c.Status == corev1.ConditionTrue, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// setPoolPaused patches the pool's spec.paused field, used to hold off the
+// controller from kicking off further node updates in the pool while this
+// node is draining/rebooting.
+func (dn *Daemon) setPoolPaused(pool *mcfgv1.MachineConfigPool, paused bool) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"paused": paused,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dn.mcfgClient.MachineconfigurationV1().MachineConfigPools().Patch(
+		context.TODO(), pool.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// coordinateDrain acquires the drain lock for this node's pool, waits for
+// any in-flight pool update to finish, and pauses the pool for the duration
+// of our own disruption. Call releaseDrainCoordination once the drain and
+// reboot sequence (or its skip) has completed.
+func (dn *Daemon) coordinateDrain() (*mcfgv1.MachineConfigPool, error) {
+	pool, err := dn.getPoolForNode()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := newDrainLock(dn.kubeClient, pool.Name, dn.name, dn.maxUnavailable)
+	if err := lock.Acquire(dn.stopCh); err != nil {
+		return nil, fmt.Errorf("acquiring drain lock for pool %s: %v", pool.Name, err)
+	}
+	dn.drainLock = lock
+
+	if err := dn.waitForPoolUpdated(pool); err != nil {
+		lock.Release()
+		dn.drainLock = nil
+		return nil, fmt.Errorf("waiting for pool %s to settle: %v", pool.Name, err)
+	}
+
+	if err := dn.setPoolPaused(pool, true); err != nil {
+		lock.Release()
+		dn.drainLock = nil
+		return nil, fmt.Errorf("pausing pool %s: %v", pool.Name, err)
+	}
+
+	return pool, nil
+}
+
+// releaseDrainCoordination releases this node's drain lock slot and, only
+// once no other node in the pool still holds one, unpauses the pool. With
+// maxUnavailable > 1 several nodes can hold a slot and pause the pool at
+// once; unpausing as soon as any single one of them finishes would reopen
+// the pool to further controller-driven updates while its siblings are
+// still mid-drain/reboot.
+func (dn *Daemon) releaseDrainCoordination(pool *mcfgv1.MachineConfigPool) {
+	// The lock may have been acquired by a previous instance of the
+	// daemon (we're finalizing after a reboot), so don't rely on
+	// dn.drainLock being populated: re-derive it from the pool instead.
+	lock := dn.drainLock
+	if lock == nil {
+		lock = newDrainLock(dn.kubeClient, pool.Name, dn.name, dn.maxUnavailable)
+	}
+	remaining, err := lock.Release()
+	if err != nil {
+		glog.Errorf("failed to release drain lock for pool %s: %v", pool.Name, err)
+	}
+	dn.drainLock = nil
+
+	if remaining > 0 {
+		glog.Infof("drain lock: %d other node(s) still hold a slot for pool %s, leaving it paused", remaining, pool.Name)
+		return
+	}
+	if err := dn.setPoolPaused(pool, false); err != nil {
+		glog.Errorf("failed to unpause pool %s: %v", pool.Name, err)
+	}
+}
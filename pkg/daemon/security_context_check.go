@@ -0,0 +1,155 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"syscall"
+
+	"github.com/golang/glog"
+	selinuxlabel "github.com/opencontainers/selinux/go-selinux/label"
+	"github.com/pkg/errors"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+)
+
+const (
+	// fileSecurityContextAnnotationKey holds a JSON-encoded
+	// map[path]fileSecurityContext describing the SELinux label and
+	// security-relevant xattrs a MachineConfig expects for specific
+	// files. Ignition v2.2 has no first-class field for this, so we
+	// thread it through as an MCO-specific annotation until Ignition
+	// gains one.
+	fileSecurityContextAnnotationKey = "machineconfiguration.openshift.io/file-security-context"
+)
+
+// allowedXattrs is the set of extended attributes checkFiles compares on
+// drift. We intentionally don't check every xattr a file might carry, only
+// the ones that are security relevant and cheap to keep in sync.
+var allowedXattrs = []string{"security.capability", "security.ima"}
+
+// fileSecurityContext is the expected SELinux label and xattr values for a
+// single path, as declared by fileSecurityContextAnnotationKey.
+type fileSecurityContext struct {
+	// SELinux is the expected context string, e.g. "system_u:object_r:kubelet_exec_t:s0".
+	SELinux string `json:"selinux,omitempty"`
+	// Xattrs maps an xattr name (must be in allowedXattrs) to its
+	// expected value, hex-encoded since xattr values are arbitrary bytes.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+}
+
+// securityContextsFromConfig parses mc's fileSecurityContextAnnotationKey
+// annotation, if present, into a map keyed by file path.
+func securityContextsFromConfig(mc *mcfgv1.MachineConfig) (map[string]fileSecurityContext, error) {
+	raw, ok := mc.Annotations[fileSecurityContextAnnotationKey]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var contexts map[string]fileSecurityContext
+	if err := json.Unmarshal([]byte(raw), &contexts); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s annotation", fileSecurityContextAnnotationKey)
+	}
+	return contexts, nil
+}
+
+// checkSecurityContext compares path's on-disk SELinux label and allow-
+// listed xattrs against expected, logging and returning false on the first
+// mismatch found so the caller can identify precisely which attribute
+// drifted.
+func checkSecurityContext(path string, expected fileSecurityContext) bool {
+	if expected.SELinux != "" {
+		actual, err := selinuxlabel.FileLabel(path)
+		if err != nil {
+			glog.Errorf("state validation: could not read SELinux label for %q: %v", path, err)
+			return false
+		}
+		if actual != expected.SELinux {
+			glog.Errorf("state validation: SELinux label mismatch for %q; expected: %q; received: %q", path, expected.SELinux, actual)
+			return false
+		}
+	}
+
+	for _, name := range allowedXattrs {
+		expectedHex, ok := expected.Xattrs[name]
+		if !ok {
+			continue
+		}
+		expectedValue, err := hex.DecodeString(expectedHex)
+		if err != nil {
+			glog.Errorf("state validation: invalid expected xattr %q for %q: %v", name, path, err)
+			return false
+		}
+		actualValue, err := getXattr(path, name)
+		if err != nil {
+			glog.Errorf("state validation: could not read xattr %q for %q: %v", name, path, err)
+			return false
+		}
+		if !bytesEqual(actualValue, expectedValue) {
+			glog.Errorf("state validation: xattr %q mismatch for %q", name, path)
+			return false
+		}
+	}
+
+	return true
+}
+
+// getXattr reads a single extended attribute's value from path.
+func getXattr(path, name string) ([]byte, error) {
+	// Probe for the needed buffer size first, since xattr values don't
+	// have a fixed length.
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreFileSecurityContext relabels path and restores its allow-listed
+// xattrs to match expected. It's the write-side counterpart to
+// checkSecurityContext, called by writeFiles right after committing a
+// file's contents so drift in labels/xattrs gets corrected the same way
+// content drift does, rather than only ever being detected. Like
+// checkSecurityContext, it only ever touches xattrs in allowedXattrs: the
+// MachineConfig's fileSecurityContextAnnotationKey is attacker-controlled
+// input, and nothing past that allowlist should be writable through it.
+func restoreFileSecurityContext(path string, expected fileSecurityContext) error {
+	if expected.SELinux != "" {
+		if err := selinuxlabel.SetFileLabel(path, expected.SELinux); err != nil {
+			return fmt.Errorf("relabeling %q to %q: %v", path, expected.SELinux, err)
+		}
+	}
+	for _, name := range allowedXattrs {
+		expectedHex, ok := expected.Xattrs[name]
+		if !ok {
+			continue
+		}
+		value, err := hex.DecodeString(expectedHex)
+		if err != nil {
+			return fmt.Errorf("decoding expected xattr %q for %q: %v", name, path, err)
+		}
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("restoring xattr %q on %q: %v", name, path, err)
+		}
+	}
+	return nil
+}
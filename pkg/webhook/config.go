@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	admissionregv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// WebhookConfigurationName is the name of the
+	// ValidatingWebhookConfiguration this package's Server backs.
+	WebhookConfigurationName = "machine-config-validation"
+
+	// webhookPath is the path Server.handleValidate is registered at.
+	webhookPath = "/validate-machineconfig"
+)
+
+// NewValidatingWebhookConfiguration builds the ValidatingWebhookConfiguration
+// for the MachineConfig webhook, pointing at the in-cluster Service fronting
+// Server. caBundle is the PEM-encoded CA used to verify the webhook's
+// serving certificate.
+func NewValidatingWebhookConfiguration(serviceName, serviceNamespace string, caBundle []byte) *admissionregv1.ValidatingWebhookConfiguration {
+	path := webhookPath
+	sideEffects := admissionregv1.SideEffectClassNone
+	failurePolicy := admissionregv1.Ignore
+
+	return &admissionregv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: WebhookConfigurationName,
+		},
+		Webhooks: []admissionregv1.ValidatingWebhook{
+			{
+				Name:                    "machineconfig.machineconfiguration.openshift.io",
+				AdmissionReviewVersions: []string{"v1"},
+				SideEffects:             &sideEffects,
+				FailurePolicy:           &failurePolicy,
+				ClientConfig: admissionregv1.WebhookClientConfig{
+					Service: &admissionregv1.ServiceReference{
+						Name:      serviceName,
+						Namespace: serviceNamespace,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregv1.RuleWithOperations{
+					{
+						Operations: []admissionregv1.OperationType{
+							admissionregv1.Create,
+							admissionregv1.Update,
+							admissionregv1.Delete,
+						},
+						Rule: admissionregv1.Rule{
+							APIGroups:   []string{"machineconfiguration.openshift.io"},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"machineconfigs"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
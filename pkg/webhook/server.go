@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+)
+
+var (
+	scheme = runtime.NewScheme()
+	codecs = serializer.NewCodecFactory(scheme)
+)
+
+func init() {
+	utilAddToScheme(scheme)
+}
+
+// utilAddToScheme registers just what this package needs to decode
+// AdmissionReview requests; kept separate so it's easy to see exactly what
+// we depend on.
+func utilAddToScheme(s *runtime.Scheme) {
+	admissionv1.AddToScheme(s) // nolint:errcheck
+}
+
+// Server serves the MachineConfig ValidatingWebhookConfiguration endpoint.
+// It reuses the same checks pkg/daemon applies when validating on-disk
+// state, so a typo'd path or unparseable Ignition fragment is rejected
+// before it ever reaches a node and degrades a pool.
+type Server struct {
+	// CertFile/KeyFile are the TLS serving certificate the
+	// ValidatingWebhookConfiguration's caBundle was generated from.
+	CertFile string
+	KeyFile  string
+	// Addr is the address to listen on, e.g. ":8443".
+	Addr string
+}
+
+// ListenAndServeTLS starts the webhook's HTTPS server; it blocks until the
+// server exits.
+func (s *Server) ListenAndServeTLS() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate-machineconfig", s.handleValidate)
+	httpServer := &http.Server{Addr: s.Addr, Handler: mux}
+	glog.Infof("MachineConfig validating webhook listening on %s", s.Addr)
+	return httpServer.ListenAndServeTLS(s.CertFile, s.KeyFile)
+}
+
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	review, err := decodeAdmissionReview(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = s.review(review.Request)
+	review.Response.UID = review.Request.UID
+
+	resp, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding admission response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp) // nolint:errcheck
+}
+
+func (s *Server) review(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation == admissionv1.Delete {
+		warnings := ValidateMachineConfigDeletion(req.Name)
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	}
+
+	var mc mcfgv1.MachineConfig
+	if err := json.Unmarshal(req.Object.Raw, &mc); err != nil {
+		return deniedResponse(fmt.Errorf("decoding MachineConfig: %v", err))
+	}
+
+	errs, warnings := ValidateMachineConfig(&mc)
+	if len(errs) > 0 {
+		return deniedResponse(combineErrors(errs))
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+}
+
+func combineErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	msg := fmt.Sprintf("%d validation errors:", len(errs))
+	for _, e := range errs {
+		msg += "\n  - " + e.Error()
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func deniedResponse(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}
+}
+
+func decodeAdmissionReview(r *http.Request) (*admissionv1.AdmissionReview, error) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %v", err)
+	}
+
+	deserializer := codecs.UniversalDeserializer()
+	review := &admissionv1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, review); err != nil {
+		return nil, fmt.Errorf("decoding admission review: %v", err)
+	}
+	if review.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+	return review, nil
+}
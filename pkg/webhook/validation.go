@@ -0,0 +1,125 @@
+// Package webhook implements a ValidatingWebhookConfiguration admission
+// webhook for MachineConfig objects, so obviously broken input (a typo'd
+// path, an unparseable Ignition data URL, a malformed osImageURL) is
+// rejected at apply time instead of only being discovered once the whole
+// pool goes Degraded.
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	imgref "github.com/containers/image/docker/reference"
+	"github.com/vincent-petithory/dataurl"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+)
+
+// defaultPoolMachineConfigPrefixes name the rendered MachineConfigs of
+// MCO's built-in pools. Deleting one of these doesn't necessarily break
+// anything by itself (the controller will re-render), but it's unusual
+// enough to warrant a warning rather than a silent allow, mirroring the
+// "shouldn't be deleted" warning sriov-network-operator's webhook gives for
+// its own default SriovOperatorConfig.
+var defaultPoolMachineConfigPrefixes = []string{"rendered-master-", "rendered-worker-"}
+
+// ValidateMachineConfig runs the same checks the daemon itself uses to
+// decide whether on-disk state matches a MachineConfig, but ahead of time
+// against the object as submitted. Hard errors should cause the webhook to
+// reject the request; warnings should be surfaced to the caller but not
+// block it.
+func ValidateMachineConfig(mc *mcfgv1.MachineConfig) (errs []error, warnings []string) {
+	if err := validateFiles(mc); err != nil {
+		errs = append(errs, err...)
+	}
+	if err := validateUnits(mc); err != nil {
+		errs = append(errs, err...)
+	}
+	if mc.Spec.OSImageURL != "" {
+		if _, err := imgref.ParseNamed(mc.Spec.OSImageURL); err != nil {
+			errs = append(errs, fmt.Errorf("spec.osImageURL %q is not a valid image reference: %v", mc.Spec.OSImageURL, err))
+		}
+	}
+	return errs, warnings
+}
+
+// ValidateMachineConfigDeletion checks a MachineConfig deletion request,
+// returning a warning (not an error) when the object looks like it backs
+// one of MCO's default pools.
+func ValidateMachineConfigDeletion(name string) (warnings []string) {
+	for _, prefix := range defaultPoolMachineConfigPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			warnings = append(warnings, fmt.Sprintf("%s is a rendered MachineConfig for one of the cluster's default pools; the controller will re-render it shortly after deletion", name))
+		}
+	}
+	return warnings
+}
+
+// validateFiles checks every storage.files[*].path with the same
+// daemon.ValidPath the MCD itself uses, dry-runs decoding each file's data
+// URL contents, and rejects duplicate paths the same way checkFiles'
+// checkedFiles map does at apply time (last write wins there, which is
+// surprising enough to reject outright here).
+func validateFiles(mc *mcfgv1.MachineConfig) []error {
+	var errs []error
+	seen := make(map[string]bool)
+
+	for _, f := range mc.Spec.Config.Storage.Files {
+		if !daemon.ValidPath(f.Path) {
+			errs = append(errs, fmt.Errorf("storage.files path %q is not a valid absolute or relative path", f.Path))
+			continue
+		}
+		if seen[f.Path] {
+			errs = append(errs, fmt.Errorf("storage.files contains duplicate path %q", f.Path))
+			continue
+		}
+		seen[f.Path] = true
+
+		if f.Contents.Source == "" {
+			continue
+		}
+		if _, err := dataurl.DecodeString(f.Contents.Source); err != nil {
+			errs = append(errs, fmt.Errorf("storage.files path %q has an unparseable contents source: %v", f.Path, err))
+		}
+	}
+
+	return errs
+}
+
+// validateUnits sanity-checks systemd unit names and dropin names; a unit
+// with no trailing ".service"/".socket"/etc suffix, or an empty name, would
+// otherwise only be caught once checkUnits starts failing to find it on
+// disk post-reboot.
+func validateUnits(mc *mcfgv1.MachineConfig) []error {
+	var errs []error
+	for _, u := range mc.Spec.Config.Systemd.Units {
+		if u.Name == "" {
+			errs = append(errs, fmt.Errorf("systemd.units contains a unit with an empty name"))
+			continue
+		}
+		if !hasSystemdUnitSuffix(u.Name) {
+			errs = append(errs, fmt.Errorf("systemd unit %q does not have a recognized unit suffix", u.Name))
+		}
+		for _, d := range u.Dropins {
+			if d.Name == "" {
+				errs = append(errs, fmt.Errorf("unit %q has a dropin with an empty name", u.Name))
+			}
+		}
+	}
+	return errs
+}
+
+var systemdUnitSuffixes = []string{
+	".service", ".socket", ".device", ".mount", ".automount",
+	".swap", ".target", ".path", ".timer", ".slice", ".scope",
+}
+
+func hasSystemdUnitSuffix(name string) bool {
+	for _, suffix := range systemdUnitSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}